@@ -0,0 +1,134 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package db
+
+// recordExtras folds rec's extras and unknownTags into the session's
+// running view of the latest MANIFEST state, the same way logAndApply
+// already folds forward rec's scalar fields (logNum, nextNum,
+// sequence). It must be called for every record logAndApply installs,
+// so that a later snapshotManifest rewrite has the full set of
+// registered and unrecognized user tags to carry forward via
+// mergeExtras, rather than just the table list tracked by *version.
+func (s *session) recordExtras(rec *sessionRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tag, v := range rec.extras {
+		if s.extras == nil {
+			s.extras = make(map[uint64]interface{})
+		}
+		s.extras[tag] = v
+	}
+	for tag, raw := range rec.unknownTags {
+		if s.unknownTags == nil {
+			s.unknownTags = make(map[uint64][]byte)
+		}
+		s.unknownTags[tag] = raw
+	}
+}
+
+// snapshotDue reports whether editsSinceSnapshot+editCount crosses
+// threshold and no rewrite is already in flight, and returns the updated
+// edit count to store either way. Split out from maybeSnapshotManifest
+// so the threshold arithmetic can be tested without a *session, which
+// this tree has no constructor for.
+func snapshotDue(editsSinceSnapshot, editCount, threshold int, snapshotting bool) (newCount int, due bool) {
+	newCount = editsSinceSnapshot + editCount
+	due = threshold > 0 && newCount >= threshold && !snapshotting
+	return newCount, due
+}
+
+// maybeSnapshotManifest is called after logAndApply installs editCount
+// more session-record edits. Once opt.Options.ManifestSnapshotThreshold
+// edits have accumulated since the last rewrite, it replaces the whole
+// incremental tail of tagNewTable/tagDeletedTable records with a single
+// base record describing the version's current state, keeping recovery
+// cost proportional to the live file set rather than to history.
+//
+// At most one rewrite runs at a time: s.snapshotting guards against two
+// calls both observing the threshold crossed while a rewrite is still in
+// flight (editsSinceSnapshot isn't reset until the rewrite completes),
+// which would otherwise race on s.manifestNum/CURRENT and could Remove
+// the same old MANIFEST file twice.
+func (s *session) maybeSnapshotManifest(editCount int) error {
+	s.mu.Lock()
+	newCount, due := snapshotDue(s.editsSinceSnapshot, editCount, s.o.ManifestSnapshotThreshold, s.snapshotting)
+	s.editsSinceSnapshot = newCount
+	if due {
+		s.snapshotting = true
+	}
+	s.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	err := s.snapshotManifest()
+
+	s.mu.Lock()
+	s.snapshotting = false
+	s.mu.Unlock()
+
+	return err
+}
+
+// snapshotManifest unconditionally rewrites the MANIFEST as a single
+// base record for the current version. The rewrite follows the same
+// crash-safe sequence as the C++ implementation: write MANIFEST-N under
+// a fresh file number, fsync it, atomically repoint CURRENT at it, and
+// only then unlink the old MANIFEST.
+func (s *session) snapshotManifest() error {
+	s.mu.Lock()
+	v := s.version()
+	logNum := s.logNum
+	nextNum := s.nextNum
+	sequence := s.sequence
+	extras := make(map[uint64]interface{}, len(s.extras))
+	for tag, val := range s.extras {
+		extras[tag] = val
+	}
+	unknownTags := make(map[uint64][]byte, len(s.unknownTags))
+	for tag, raw := range s.unknownTags {
+		unknownTags[tag] = raw
+	}
+	s.mu.Unlock()
+
+	rec := new(sessionRecord).snapshot(v)
+	rec.mergeExtras(extras, unknownTags)
+	rec.setComparator(s.icmp.userComparator().Name())
+	rec.setLogNum(logNum)
+	rec.setNextNum(nextNum)
+	rec.setSequence(sequence)
+
+	num := s.allocFileNum()
+	w, err := s.stor.Create(s.manifestFileNum(num))
+	if err != nil {
+		return err
+	}
+	if err = rec.encodeTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	oldNum := s.manifestNum
+	if err = s.setCurrent(num); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.manifestNum = num
+	s.editsSinceSnapshot = 0
+	s.mu.Unlock()
+
+	return s.stor.Remove(s.manifestFileNum(oldNum))
+}
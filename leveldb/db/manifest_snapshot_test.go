@@ -0,0 +1,70 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestSnapshotDue exercises the threshold bookkeeping ApplyGroup relies
+// on to trigger a rewrite, independent of *session: a disabled
+// threshold never fires, crossing it fires exactly once, and a rewrite
+// already in flight suppresses a second trigger even past threshold.
+func TestSnapshotDue(t *testing.T) {
+	if newCount, due := snapshotDue(0, 3, 0, false); due || newCount != 3 {
+		t.Fatalf("threshold=0 must never be due, got newCount=%d due=%v", newCount, due)
+	}
+	if newCount, due := snapshotDue(8, 1, 10, false); !due || newCount != 9 {
+		t.Fatalf("crossing threshold must be due, got newCount=%d due=%v", newCount, due)
+	}
+	if newCount, due := snapshotDue(8, 1, 10, true); due || newCount != 9 {
+		t.Fatalf("a rewrite already in flight must suppress due, got newCount=%d due=%v", newCount, due)
+	}
+	if newCount, due := snapshotDue(3, 1, 10, false); due || newCount != 4 {
+		t.Fatalf("below threshold must not be due, got newCount=%d due=%v", newCount, due)
+	}
+}
+
+// snapshotManifest's walk over *version has no coverage here: this
+// source tree carries no version.go, so *version can't be constructed
+// in a test. What's exercised below is the part of the rewrite path
+// chunk0-4 introduced to avoid dropping user tags across a rewrite:
+// mergeExtras, and that its output still round-trips through the framed
+// encode/decode path a MANIFEST rewrite uses.
+func TestSnapshotRecordCarriesExtrasAcrossRewrite(t *testing.T) {
+	const known = userTagBase + 300
+	const unknown = userTagBase + 301
+	encode, decode := bytesTagCodec()
+	RegisterSessionTag(known, encode, decode)
+
+	rec := &sessionRecord{}
+	rec.setLogNum(5)
+	rec.mergeExtras(
+		map[uint64]interface{}{known: []byte("carried")},
+		map[uint64][]byte{unknown: []byte("raw")},
+	)
+
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded sessionRecord
+	if err := decoded.decode(buf.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok := decoded.getExtra(known)
+	if !ok || string(v.([]byte)) != "carried" {
+		t.Fatalf("registered extra lost across rewrite round trip: %v, ok=%v", v, ok)
+	}
+	raw, ok := decoded.unknownTags[unknown]
+	if !ok || string(raw) != "raw" {
+		t.Fatalf("unknown tag lost across rewrite round trip: %v, ok=%v", raw, ok)
+	}
+}
@@ -16,8 +16,11 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"leveldb"
+	"sync"
 )
 
 // These numbers are written to disk and should not be changed.
@@ -37,6 +40,47 @@ const (
 
 const tagMax = tagPrevLogNum
 
+// userTagBase is the first tag number available to RegisterSessionTag.
+// Tags below it are reserved for this package; a MANIFEST reader that
+// only knows tags up to tagMax can still skip over a user tag safely
+// because every user tag payload is length-prefixed.
+const userTagBase = 1 << 16
+
+type sessionTagCodec struct {
+	encode func(interface{}) ([]byte, error)
+	decode func([]byte) (interface{}, error)
+}
+
+var (
+	userTagsMu sync.RWMutex
+	userTags   = map[uint64]sessionTagCodec{}
+)
+
+// RegisterSessionTag registers an encoder/decoder pair for a custom
+// MANIFEST tag, so that a consumer embedding this package (a chain store
+// keeping its own index, say) can persist extra per-version state in the
+// session record without forking it. tag must be >= userTagBase.
+//
+// Values set via (*sessionRecord).setExtra under tag are passed through
+// encode when the record is written, and the bytes produced by encode
+// are passed through decode to repopulate the value when the record is
+// read back.
+func RegisterSessionTag(tag uint64, encode func(interface{}) ([]byte, error), decode func([]byte) (interface{}, error)) {
+	if tag < userTagBase {
+		panic("db: RegisterSessionTag: tag is below userTagBase")
+	}
+	userTagsMu.Lock()
+	defer userTagsMu.Unlock()
+	userTags[tag] = sessionTagCodec{encode, decode}
+}
+
+func lookupSessionTag(tag uint64) (sessionTagCodec, bool) {
+	userTagsMu.RLock()
+	defer userTagsMu.RUnlock()
+	codec, ok := userTags[tag]
+	return codec, ok
+}
+
 var tagBytesCache [tagMax + 1][]byte
 
 func init() {
@@ -49,6 +93,45 @@ func init() {
 	}
 }
 
+// crc32cTable and the mask/unmask helpers below mirror the framing used by
+// the write-ahead log records: a CRC32-C checksum, rotated and offset by a
+// fixed delta so that a record that happens to contain another record's
+// encoded checksum doesn't checksum-match by coincidence.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+const crcMaskDelta = 0xa282ead8
+
+func maskCRC(c uint32) uint32 {
+	return ((c >> 15) | (c << 17)) + crcMaskDelta
+}
+
+func unmaskCRC(maskedCRC uint32) uint32 {
+	rot := maskedCRC - crcMaskDelta
+	return (rot >> 17) | (rot << 15)
+}
+
+// maxSessionRecordLen bounds the length prefix read by decodeFrom. A
+// single session record holding a realistic number of table/compact-
+// pointer entries is nowhere near this size; the bound exists so that a
+// flipped bit in the length field can't turn a small, truncated record
+// into a multi-gigabyte allocation.
+const maxSessionRecordLen = 64 << 20 // 64MiB
+
+// ErrManifestCorrupted is returned when a MANIFEST record fails to decode,
+// as opposed to a clean end of the record stream. Offset is the byte
+// offset into the record payload at which decoding failed; Tag is the
+// record tag being processed, or 0 if the failure is in the framing
+// itself (length prefix or checksum).
+type ErrManifestCorrupted struct {
+	Reason string
+	Offset int64
+	Tag    uint64
+}
+
+func (e ErrManifestCorrupted) Error() string {
+	return fmt.Sprintf("leveldb/db: MANIFEST corrupted at offset %d (tag=%d): %s", e.Offset, e.Tag, e.Reason)
+}
+
 type cpRecord struct {
 	level int
 	key   iKey
@@ -87,6 +170,29 @@ type sessionRecord struct {
 	compactPointers []cpRecord
 	newTables       []ntRecord
 	deletedTables   []dtRecord
+
+	// extras holds decoded values for registered user tags (see
+	// RegisterSessionTag). unknownTags holds the raw bytes of tags in the
+	// reserved range that had no codec registered at decode time, so they
+	// round-trip unchanged through a read-modify-write of the MANIFEST
+	// instead of being silently dropped for an older binary.
+	extras      map[uint64]interface{}
+	unknownTags map[uint64][]byte
+}
+
+// setExtra attaches a value for a registered user tag to the record.
+// tag must be >= userTagBase; see RegisterSessionTag.
+func (p *sessionRecord) setExtra(tag uint64, v interface{}) {
+	if p.extras == nil {
+		p.extras = make(map[uint64]interface{})
+	}
+	p.extras[tag] = v
+}
+
+// getExtra returns the value previously attached for tag, if any.
+func (p *sessionRecord) getExtra(tag uint64) (interface{}, bool) {
+	v, ok := p.extras[tag]
+	return v, ok
 }
 
 func (p *sessionRecord) setComparator(name string) {
@@ -121,11 +227,55 @@ func (p *sessionRecord) addTableFile(level int, t *tFile) {
 	p.addTable(level, t.file.Number(), t.size, t.smallest, t.largest)
 }
 
+// snapshot returns a new sessionRecord describing v's base state: every
+// live table at every level, plus the current per-level compaction
+// pointers. It leaves the comparator name and log/next/sequence numbers
+// unset, since those are owned by the session rather than the version;
+// the caller (see (*session).snapshotManifest) fills them in before
+// writing the record.
+func (p *sessionRecord) snapshot(v *version) *sessionRecord {
+	rec := &sessionRecord{}
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			rec.addTableFile(level, t)
+		}
+	}
+	for level, key := range v.compactPointers {
+		if len(key) > 0 {
+			rec.addCompactPointer(level, key)
+		}
+	}
+	return rec
+}
+
 func (p *sessionRecord) deleteTable(level int, num uint64) {
 	p.deletedTables = append(p.deletedTables, dtRecord{level, num})
 }
 
+// encodeTo writes p framed as a length-prefixed, CRC32-C checksummed
+// record, matching the log-record framing style used elsewhere in
+// LevelDB, so that a truncated or corrupted MANIFEST entry can be
+// detected by decodeFrom instead of silently misparsing.
 func (p *sessionRecord) encodeTo(w io.Writer) (err error) {
+	buf := new(bytes.Buffer)
+	if err = p.encodeRecordTo(buf); err != nil {
+		return
+	}
+
+	payload := buf.Bytes()
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:8], maskCRC(crc32.Checksum(payload, crc32cTable)))
+
+	if _, err = w.Write(hdr[:]); err != nil {
+		return
+	}
+	_, err = w.Write(payload)
+	return
+}
+
+// encodeRecordTo writes the unframed tag/value stream for p.
+func (p *sessionRecord) encodeRecordTo(w io.Writer) (err error) {
 	tmp := make([]byte, binary.MaxVarintLen64)
 
 	putUvarint := func(p uint64) (err error) {
@@ -247,6 +397,38 @@ func (p *sessionRecord) encodeTo(w io.Writer) (err error) {
 		}
 	}
 
+	for tag, v := range p.extras {
+		codec, ok := lookupSessionTag(tag)
+		if !ok {
+			err = fmt.Errorf("db: no codec registered for session tag %d", tag)
+			return
+		}
+		var enc []byte
+		enc, err = codec.encode(v)
+		if err != nil {
+			return
+		}
+		err = putUvarint(tag)
+		if err != nil {
+			return
+		}
+		err = putBytes(enc)
+		if err != nil {
+			return
+		}
+	}
+
+	for tag, raw := range p.unknownTags {
+		err = putUvarint(tag)
+		if err != nil {
+			return
+		}
+		err = putBytes(raw)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
@@ -256,13 +438,110 @@ func (p *sessionRecord) encode() []byte {
 	return b.Bytes()
 }
 
-func (p *sessionRecord) decodeFrom(r readByteReader) (err error) {
+// decodeFrom reads a single framed MANIFEST record from r into p: an
+// 8-byte length+CRC32-C header followed by the tag/value payload written
+// by encodeTo. It returns nil at a clean end of stream (no header could
+// be read at all), and an ErrManifestCorrupted if a header or payload is
+// present but malformed.
+//
+// onSkip, if non-nil, is how a corrupted header/payload/record is
+// reported instead of aborting: it is called with the ErrManifestCorrupted
+// that was hit so the caller can log it, and decodeFrom then returns nil
+// (clean header/payload truncation) or carries on to the record that
+// follows (checksum mismatch or a bad tag/value, where the length prefix
+// already told us exactly where that is) rather than returning the error
+// itself. Passing a nil onSkip makes any corruption fatal, same as if it
+// had never been offered a chance to recover.
+//
+// This does not apply to errors that aren't actually corruption, such as
+// tagPrevLogNum's incompatible-format sentinel, nor to a length prefix so
+// large that the next record's boundary can't be trusted: both are
+// always returned to the caller untouched.
+func (p *sessionRecord) decodeFrom(r readByteReader, onSkip func(err error)) (err error) {
+	for {
+		var hdr [8]byte
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+				return
+			}
+			cerr := ErrManifestCorrupted{Reason: "truncated record header: " + err.Error()}
+			if onSkip == nil {
+				err = cerr
+				return
+			}
+			onSkip(cerr)
+			err = nil
+			return
+		}
+
+		length := binary.LittleEndian.Uint32(hdr[0:4])
+		wantCRC := unmaskCRC(binary.LittleEndian.Uint32(hdr[4:8]))
+
+		if length > maxSessionRecordLen {
+			// An invalid length means the next record's boundary can't
+			// be located, so there is nothing safe to skip to: this is
+			// always reported, even with onSkip set.
+			err = ErrManifestCorrupted{Reason: "record length exceeds maximum"}
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			cerr := ErrManifestCorrupted{Reason: "truncated record payload"}
+			if onSkip == nil {
+				err = cerr
+				return
+			}
+			onSkip(cerr)
+			err = nil
+			return
+		}
+
+		if gotCRC := crc32.Checksum(payload, crc32cTable); gotCRC != wantCRC {
+			cerr := ErrManifestCorrupted{Reason: "checksum mismatch"}
+			if onSkip == nil {
+				err = cerr
+				return
+			}
+			onSkip(cerr)
+			continue
+		}
+
+		// Decode into a scratch record rather than p directly: a
+		// corrupted payload can fail partway through, after already
+		// writing some fields, and a skipped record must not leak
+		// those into whatever record follows it.
+		var tmp sessionRecord
+		if rerr := tmp.decodeRecordFrom(bytes.NewReader(payload)); rerr != nil {
+			if _, ok := rerr.(ErrManifestCorrupted); ok && onSkip != nil {
+				onSkip(rerr)
+				continue
+			}
+			err = rerr
+			return
+		}
+		*p = tmp
+		return nil
+	}
+}
+
+// decodeRecordFrom decodes the unframed tag/value stream produced by
+// encodeRecordTo. A malformed tag or value is reported as an
+// ErrManifestCorrupted carrying the byte offset and tag at which decoding
+// failed, so callers can tell a corrupt entry apart from a clean io.EOF.
+func (p *sessionRecord) decodeRecordFrom(r *bytes.Reader) (err error) {
+	total := r.Len()
+	offset := func() int64 { return int64(total - r.Len()) }
+
 	for err == nil {
 		var tag uint64
 		tag, err = binary.ReadUvarint(r)
 		if err != nil {
 			if err == io.EOF {
 				err = nil
+			} else {
+				err = ErrManifestCorrupted{Reason: "invalid tag varint", Offset: offset(), Tag: tag}
 			}
 			return
 		}
@@ -344,13 +623,104 @@ func (p *sessionRecord) decodeFrom(r readByteReader) (err error) {
 				break
 			}
 			p.deleteTable(int(level), num)
+		default:
+			if tag < userTagBase {
+				err = fmt.Errorf("unknown tag")
+				break
+			}
+			var raw []byte
+			raw, err = readBytes(r)
+			if err != nil {
+				break
+			}
+			if codec, ok := lookupSessionTag(tag); ok {
+				var v interface{}
+				v, err = codec.decode(raw)
+				if err != nil {
+					break
+				}
+				p.setExtra(tag, v)
+			} else {
+				if p.unknownTags == nil {
+					p.unknownTags = make(map[uint64][]byte)
+				}
+				p.unknownTags[tag] = raw
+			}
+		}
+
+		if err != nil {
+			// tagPrevLogNum's error is a deliberate "this MANIFEST
+			// predates a format this build understands" sentinel, not
+			// bit-rot: it must stay distinguishable from
+			// ErrManifestCorrupted and must not be swallowed by
+			// skipCorrupted at the caller.
+			if tag == tagPrevLogNum {
+				return
+			}
+			err = ErrManifestCorrupted{Reason: err.Error(), Offset: offset(), Tag: tag}
 		}
 	}
 
 	return
 }
 
-func (p *sessionRecord) decode(buf []byte) error {
+func (p *sessionRecord) decode(buf []byte, onSkip func(err error)) error {
 	b := bytes.NewBuffer(buf)
-	return p.decodeFrom(b)
+	return p.decodeFrom(b, onSkip)
+}
+
+// mergeSessionRecords combines a sequence of edits into a single
+// sessionRecord: the last edit to set a given scalar field (comparator,
+// log/next number, sequence) wins, and compact-pointer, table, and
+// user-tag entries from every edit are concatenated in order. It does
+// not deduplicate add/delete pairs; that is the job of whatever installs
+// the merged record against a *version.
+func mergeSessionRecords(edits []*sessionRecord) *sessionRecord {
+	rec := &sessionRecord{}
+	for _, e := range edits {
+		if e.hasComparator {
+			rec.setComparator(e.comparator)
+		}
+		if e.hasLogNum {
+			rec.setLogNum(e.logNum)
+		}
+		if e.hasNextNum {
+			rec.setNextNum(e.nextNum)
+		}
+		if e.hasSequence {
+			rec.setSequence(e.sequence)
+		}
+		rec.compactPointers = append(rec.compactPointers, e.compactPointers...)
+		rec.newTables = append(rec.newTables, e.newTables...)
+		rec.deletedTables = append(rec.deletedTables, e.deletedTables...)
+		for tag, v := range e.extras {
+			rec.setExtra(tag, v)
+		}
+		for tag, raw := range e.unknownTags {
+			if rec.unknownTags == nil {
+				rec.unknownTags = make(map[uint64][]byte)
+			}
+			rec.unknownTags[tag] = raw
+		}
+	}
+	return rec
+}
+
+// mergeExtras copies extras and unknownTags onto the record. It exists
+// so that a record built by a path other than mergeSessionRecords —
+// notably (*session).snapshotManifest's base-record rewrite, which
+// otherwise only knows about *version's table set — can still carry
+// forward registered and unrecognized user tags the same way an
+// incremental edit would, instead of dropping them the moment the
+// MANIFEST is truncated.
+func (p *sessionRecord) mergeExtras(extras map[uint64]interface{}, unknownTags map[uint64][]byte) {
+	for tag, v := range extras {
+		p.setExtra(tag, v)
+	}
+	for tag, raw := range unknownTags {
+		if p.unknownTags == nil {
+			p.unknownTags = make(map[uint64][]byte)
+		}
+		p.unknownTags[tag] = raw
+	}
 }
@@ -0,0 +1,221 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func frameRecordForTest(payload []byte) []byte {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:8], maskCRC(crc32.Checksum(payload, crc32cTable)))
+	return append(hdr[:], payload...)
+}
+
+// collectSkipped returns an onSkip callback that records every error it
+// is passed, so a test can assert both that recovery happened (decode
+// returned nil) and that the reason was still reported for logging.
+func collectSkipped(skipped *[]error) func(error) {
+	return func(err error) { *skipped = append(*skipped, err) }
+}
+
+func TestSessionRecordEncodeDecodeRoundTrip(t *testing.T) {
+	rec := &sessionRecord{}
+	rec.setComparator("leveldb.BytewiseComparator")
+	rec.setLogNum(1)
+	rec.setNextNum(2)
+	rec.setSequence(3)
+	rec.addCompactPointer(0, iKey("a"))
+	rec.addTable(0, 7, 123, iKey("a"), iKey("z"))
+	rec.deleteTable(1, 4)
+
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got sessionRecord
+	if err := got.decode(buf.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.comparator != rec.comparator || !got.hasComparator {
+		t.Fatalf("comparator = %q, want %q", got.comparator, rec.comparator)
+	}
+	if got.logNum != 1 || got.nextNum != 2 || got.sequence != 3 {
+		t.Fatalf("scalar fields = %+v", got)
+	}
+	if len(got.compactPointers) != 1 || len(got.newTables) != 1 || len(got.deletedTables) != 1 {
+		t.Fatalf("record lists not round-tripped: %+v", got)
+	}
+}
+
+func TestSessionRecordDecodeCorruptedChecksum(t *testing.T) {
+	rec := &sessionRecord{}
+	rec.setLogNum(42)
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	framed := buf.Bytes()
+	framed[8] ^= 0xff // flip a payload bit, leaving the header untouched
+
+	var got sessionRecord
+	err := got.decode(framed, nil)
+	if _, ok := err.(ErrManifestCorrupted); !ok {
+		t.Fatalf("want ErrManifestCorrupted, got %v (%T)", err, err)
+	}
+
+	var skipped []error
+	var got2 sessionRecord
+	if err := got2.decode(framed, collectSkipped(&skipped)); err != nil {
+		t.Fatalf("onSkip should let a checksum mismatch be recovered, got %v", err)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("want exactly one reported skip, got %d: %v", len(skipped), skipped)
+	}
+	if _, ok := skipped[0].(ErrManifestCorrupted); !ok {
+		t.Fatalf("skipped reason should be an ErrManifestCorrupted, got %v (%T)", skipped[0], skipped[0])
+	}
+}
+
+func TestSessionRecordDecodeTruncatedHeader(t *testing.T) {
+	short := []byte{1, 2, 3}
+
+	var got sessionRecord
+	err := got.decode(short, nil)
+	if _, ok := err.(ErrManifestCorrupted); !ok {
+		t.Fatalf("want ErrManifestCorrupted, got %v (%T)", err, err)
+	}
+
+	var skipped []error
+	var got2 sessionRecord
+	if err := got2.decode(short, collectSkipped(&skipped)); err != nil {
+		t.Fatalf("onSkip should let a truncated header be recovered, got %v", err)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("want exactly one reported skip, got %d: %v", len(skipped), skipped)
+	}
+}
+
+// TestSessionRecordDecodeSkipsCorruptedRecordCleanly checks that a
+// corrupted record which already wrote some fields before failing
+// doesn't leak them into the clean record that follows once onSkip
+// lets decodeFrom carry on: the returned record must be exactly the
+// second record's state, not a blend of both.
+func TestSessionRecordDecodeSkipsCorruptedRecordCleanly(t *testing.T) {
+	var badPayload []byte
+	tagBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tagBuf, tagLogNum)
+	badPayload = append(badPayload, tagBuf[:n]...)
+	n = binary.PutUvarint(tagBuf, 999)
+	badPayload = append(badPayload, tagBuf[:n]...) // logNum decodes fine
+	n = binary.PutUvarint(tagBuf, tagComparator)
+	badPayload = append(badPayload, tagBuf[:n]...)
+	n = binary.PutUvarint(tagBuf, 50) // claims a 50-byte name, none follows
+	badPayload = append(badPayload, tagBuf[:n]...)
+
+	good := &sessionRecord{}
+	good.setNextNum(7)
+	goodBuf := new(bytes.Buffer)
+	if err := good.encodeTo(goodBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	framed := append(frameRecordForTest(badPayload), goodBuf.Bytes()...)
+
+	var skipped []error
+	var got sessionRecord
+	if err := got.decode(framed, collectSkipped(&skipped)); err != nil {
+		t.Fatalf("onSkip should let the corrupted record be skipped, got %v", err)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("want exactly one reported skip, got %d: %v", len(skipped), skipped)
+	}
+	if got.hasLogNum {
+		t.Fatalf("logNum from the skipped record leaked into the result: %+v", got)
+	}
+	if !got.hasNextNum || got.nextNum != 7 {
+		t.Fatalf("result should be exactly the clean record that followed, got %+v", got)
+	}
+}
+
+func TestSessionRecordDecodeTruncatedPayload(t *testing.T) {
+	rec := &sessionRecord{}
+	rec.setLogNum(7)
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:len(buf.Bytes())-1]
+
+	var got sessionRecord
+	err := got.decode(truncated, nil)
+	if _, ok := err.(ErrManifestCorrupted); !ok {
+		t.Fatalf("want ErrManifestCorrupted, got %v (%T)", err, err)
+	}
+
+	var skipped []error
+	var got2 sessionRecord
+	if err := got2.decode(truncated, collectSkipped(&skipped)); err != nil {
+		t.Fatalf("onSkip should let a truncated payload be recovered, got %v", err)
+	}
+	if len(skipped) != 1 {
+		t.Fatalf("want exactly one reported skip, got %d: %v", len(skipped), skipped)
+	}
+}
+
+func TestSessionRecordDecodeOversizedLength(t *testing.T) {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], maxSessionRecordLen+1)
+
+	var got sessionRecord
+	err := got.decode(hdr[:], nil)
+	if _, ok := err.(ErrManifestCorrupted); !ok {
+		t.Fatalf("want ErrManifestCorrupted, got %v (%T)", err, err)
+	}
+
+	// An oversized length makes the next record boundary unknowable, so
+	// it must never be silently skipped, even with onSkip set.
+	var skipped []error
+	var got2 sessionRecord
+	if err := got2.decode(hdr[:], collectSkipped(&skipped)); err == nil {
+		t.Fatal("oversized length must not be recovered via onSkip")
+	}
+	if len(skipped) != 0 {
+		t.Fatalf("oversized length must not be reported via onSkip, got %v", skipped)
+	}
+}
+
+func TestSessionRecordDecodePrevLogNumNotCorruption(t *testing.T) {
+	tagBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tagBuf, tagPrevLogNum)
+	framed := frameRecordForTest(tagBuf[:n])
+
+	var got sessionRecord
+	err := got.decode(framed, nil)
+	if err == nil {
+		t.Fatal("expected an unsupported-format error")
+	}
+	if _, ok := err.(ErrManifestCorrupted); ok {
+		t.Fatalf("tagPrevLogNum must not be reported as ErrManifestCorrupted, got %v", err)
+	}
+
+	var skipped []error
+	var got2 sessionRecord
+	err2 := got2.decode(framed, collectSkipped(&skipped))
+	if err2 == nil {
+		t.Fatal("onSkip must not swallow an incompatible-format MANIFEST")
+	}
+	if len(skipped) != 0 {
+		t.Fatalf("onSkip must not be offered an incompatible-format MANIFEST, got %v", skipped)
+	}
+}
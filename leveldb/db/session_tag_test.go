@@ -0,0 +1,90 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func bytesTagCodec() (func(interface{}) ([]byte, error), func([]byte) (interface{}, error)) {
+	encode := func(v interface{}) ([]byte, error) { return v.([]byte), nil }
+	decode := func(b []byte) (interface{}, error) { return b, nil }
+	return encode, decode
+}
+
+func TestSessionRecordUserTagRoundTrip(t *testing.T) {
+	const tag = userTagBase + 1
+	encode, decode := bytesTagCodec()
+	RegisterSessionTag(tag, encode, decode)
+
+	rec := &sessionRecord{}
+	rec.setExtra(tag, []byte("hello"))
+
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got sessionRecord
+	if err := got.decode(buf.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := got.getExtra(tag)
+	if !ok || string(v.([]byte)) != "hello" {
+		t.Fatalf("extra not round-tripped: %v, ok=%v", v, ok)
+	}
+}
+
+// TestSessionRecordUnknownTagPreserved simulates a binary that doesn't
+// know about tag decoding it, then writing the record back out: the raw
+// tag bytes must survive untouched, and a binary that does know the tag
+// must still be able to recover the original value afterward.
+func TestSessionRecordUnknownTagPreserved(t *testing.T) {
+	const tag = userTagBase + 2
+	encode, decode := bytesTagCodec()
+	RegisterSessionTag(tag, encode, decode)
+
+	rec := &sessionRecord{}
+	rec.setExtra(tag, []byte("payload"))
+	buf := new(bytes.Buffer)
+	if err := rec.encodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	userTagsMu.Lock()
+	delete(userTags, tag)
+	userTagsMu.Unlock()
+
+	var older sessionRecord
+	if err := older.decode(buf.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := older.getExtra(tag); ok {
+		t.Fatal("tag should not have decoded without a registered codec")
+	}
+	raw, ok := older.unknownTags[tag]
+	if !ok || string(raw) != "payload" {
+		t.Fatalf("unknown tag not preserved: %v, ok=%v", raw, ok)
+	}
+
+	buf2 := new(bytes.Buffer)
+	if err := older.encodeTo(buf2); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterSessionTag(tag, encode, decode)
+
+	var newer sessionRecord
+	if err := newer.decode(buf2.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := newer.getExtra(tag)
+	if !ok || string(v.([]byte)) != "payload" {
+		t.Fatalf("value lost across read-modify-write: %v, ok=%v", v, ok)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fakeTransactionSession struct {
+	applied []*sessionRecord
+	removed []uint64
+}
+
+func (f *fakeTransactionSession) ApplyGroup(edits []*sessionRecord) error {
+	f.applied = append(f.applied, edits...)
+	return nil
+}
+
+func (f *fakeTransactionSession) removeTableFile(num uint64) error {
+	f.removed = append(f.removed, num)
+	return nil
+}
+
+func TestTransactionCommitAppliesStagedEdits(t *testing.T) {
+	fs := &fakeTransactionSession{}
+	tr := &Transaction{s: fs, rec: &sessionRecord{}}
+	tr.DeleteTable(1, 5)
+	tr.SetLogNum(3)
+
+	if err := tr.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.applied) != 1 {
+		t.Fatalf("want 1 ApplyGroup call, got %d", len(fs.applied))
+	}
+	rec := fs.applied[0]
+	if !rec.hasLogNum || rec.logNum != 3 {
+		t.Fatalf("logNum not staged: %+v", rec)
+	}
+	if len(rec.deletedTables) != 1 || rec.deletedTables[0].num != 5 {
+		t.Fatalf("deleted table not staged: %+v", rec.deletedTables)
+	}
+
+	// A second Commit must not re-apply.
+	if err := tr.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.applied) != 1 {
+		t.Fatalf("second Commit re-applied: %d calls", len(fs.applied))
+	}
+}
+
+func TestTransactionRollbackRemovesStagedTables(t *testing.T) {
+	fs := &fakeTransactionSession{}
+	tr := &Transaction{s: fs, rec: &sessionRecord{}}
+	tr.newTables = append(tr.newTables, ntRecord{level: 1, num: 7}, ntRecord{level: 2, num: 9})
+
+	if err := tr.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fs.removed, []uint64{7, 9}) {
+		t.Fatalf("removeTableFile calls = %v, want [7 9]", fs.removed)
+	}
+	if len(fs.applied) != 0 {
+		t.Fatalf("Rollback must not call ApplyGroup")
+	}
+
+	// Commit after Rollback must not apply, and a second Rollback must
+	// not remove the files again.
+	if err := tr.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.applied) != 0 {
+		t.Fatalf("Commit after Rollback applied edits")
+	}
+	if err := tr.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.removed) != 2 {
+		t.Fatalf("second Rollback removed files again: %v", fs.removed)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package opt provides tunables for opening and operating a database.
+package opt
+
+// Options holds tunable parameters for a database.
+type Options struct {
+	// ManifestSnapshotThreshold is the number of session-record edits
+	// (compaction table additions/deletions, log-number bumps, and so
+	// on) the session accumulates before it rewrites the MANIFEST as a
+	// single base record describing the current version and truncates
+	// the incremental tail. Zero disables snapshotting, leaving the
+	// MANIFEST to grow by one record per edit for the life of the
+	// database.
+	ManifestSnapshotThreshold int
+}